@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/chatcloud/backend/proto"
+	"github.com/chatcloud/backend/ratelimit"
 	"github.com/chatcloud/backend/server"
 	"github.com/go-redis/redis/v8"
 	"google.golang.org/grpc"
@@ -25,21 +28,20 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	// Create a gRPC server object
-	s := grpc.NewServer()
+	// Build the Redis client according to REDIS_MODE, so the service can
+	// run against a single node, a Sentinel-managed HA deployment, or a
+	// Cluster
+	rdb := newRedisClient()
 
-	// Initialize Redis client
-	// Get Redis address from environment variable or use the Docker service name
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "redis:6379"
-	}
-	
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	// Rate limit abusive callers per (user_id, method) before they reach
+	// the service, using limits overridable via RATE_LIMIT_<METHOD> env
+	// vars (see ratelimit.LoadLimits).
+	limiter := ratelimit.NewLimiter(rdb)
+	limits := ratelimit.LoadLimits()
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(ratelimit.UnaryServerInterceptor(limiter, limits)),
+		grpc.ChainStreamInterceptor(ratelimit.StreamServerInterceptor(limiter, limits)),
+	)
 
 	// Test Redis connection
 	ctx := context.Background()
@@ -73,3 +75,62 @@ func main() {
 	s.GracefulStop()
 	log.Println("Server stopped")
 }
+
+// newRedisClient builds a redis.UniversalClient from the environment.
+// REDIS_MODE selects the deployment topology:
+//
+//   - "single" (default): a plain client against REDIS_ADDR
+//   - "sentinel": a failover-aware client discovered via REDIS_SENTINEL_ADDRS
+//     (comma-separated host:port list) and REDIS_MASTER_NAME
+//   - "cluster": a cluster client seeded with REDIS_CLUSTER_ADDRS
+//     (comma-separated host:port list)
+//
+// REDIS_PASSWORD and REDIS_TLS (set to "true" to enable TLS with the
+// system cert pool) apply to all modes.
+func newRedisClient() redis.UniversalClient {
+	password := os.Getenv("REDIS_PASSWORD")
+
+	var tlsConfig *tls.Config
+	if os.Getenv("REDIS_TLS") == "true" {
+		tlsConfig = &tls.Config{}
+	}
+
+	switch mode := os.Getenv("REDIS_MODE"); mode {
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    os.Getenv("REDIS_MASTER_NAME"),
+			SentinelAddrs: splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS")),
+			Password:      password,
+			TLSConfig:     tlsConfig,
+		})
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS")),
+			Password:  password,
+			TLSConfig: tlsConfig,
+		})
+	default:
+		redisAddr := os.Getenv("REDIS_ADDR")
+		if redisAddr == "" {
+			redisAddr = "redis:6379"
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:      redisAddr,
+			Password:  password,
+			DB:        0,
+			TLSConfig: tlsConfig,
+		})
+	}
+}
+
+// splitAddrs turns a comma-separated host:port list into a slice,
+// dropping empty entries.
+func splitAddrs(csv string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(csv, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Limit is a token bucket's refill rate (tokens/sec) and capacity.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// DefaultLimits are the per-method limits applied when no RATE_LIMIT_*
+// override is set for a method. Methods with no entry here are not
+// rate limited.
+var DefaultLimits = map[string]Limit{
+	"/chatcloud.ChatCloud/SendMessage":   {Rate: 5, Burst: 20},
+	"/chatcloud.ChatCloud/JoinRoom":      {Rate: 1, Burst: 5},
+	"/chatcloud.ChatCloud/EditMessage":   {Rate: 2, Burst: 10},
+	"/chatcloud.ChatCloud/DeleteMessage": {Rate: 2, Burst: 10},
+	"/chatcloud.ChatCloud/React":         {Rate: 5, Burst: 20},
+	"/chatcloud.ChatCloud/Ack":           {Rate: 5, Burst: 20},
+	"/chatcloud.ChatCloud/SendTyping":    {Rate: 2, Burst: 10},
+}
+
+// overridableMethods lists every RPC that a RATE_LIMIT_<METHOD> override
+// can apply to, not just the ones with a DefaultLimits entry, so a method
+// with no default can still be throttled via config alone.
+var overridableMethods = []string{
+	"JoinRoom", "LeaveRoom", "SendMessage", "StreamMessages", "GetHistory",
+	"Heartbeat", "ListPresent", "SendTyping", "Ack", "StreamEvents",
+	"EditMessage", "DeleteMessage", "React",
+}
+
+// LoadLimits returns DefaultLimits with any RATE_LIMIT_<METHOD> environment
+// overrides applied, where <METHOD> is the RPC name upper-cased (e.g.
+// RATE_LIMIT_SENDMESSAGE="5:20" overrides SendMessage to 5 tokens/sec with
+// a burst of 20). Unlike DefaultLimits, an override can add throttling for
+// a method that has no default entry.
+func LoadLimits() map[string]Limit {
+	limits := make(map[string]Limit, len(DefaultLimits))
+	for fullMethod, limit := range DefaultLimits {
+		limits[fullMethod] = limit
+	}
+
+	for _, name := range overridableMethods {
+		envVar := "RATE_LIMIT_" + strings.ToUpper(name)
+		raw := os.Getenv(envVar)
+		if raw == "" {
+			continue
+		}
+		limit, err := parseLimit(raw)
+		if err != nil {
+			log.Printf("Ignoring invalid %s=%q: %v", envVar, raw, err)
+			continue
+		}
+		limits["/chatcloud.ChatCloud/"+name] = limit
+	}
+
+	return limits
+}
+
+// parseLimit parses a "rate:burst" string, e.g. "5:20".
+func parseLimit(raw string) (Limit, error) {
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) != 2 {
+		return Limit{}, strconv.ErrSyntax
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Limit{}, err
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Limit{}, err
+	}
+	return Limit{Rate: rate, Burst: burst}, nil
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// userIdentified is satisfied by any request message exposing a user_id
+// field, which is every request in this service's proto except
+// ListPresentRequest.
+type userIdentified interface {
+	GetUserId() string
+}
+
+// UnaryServerInterceptor rate limits unary RPCs per (user_id, method)
+// using limiter and limits. Methods with no entry in limits, or requests
+// that don't carry a user_id, pass through unlimited.
+func UnaryServerInterceptor(limiter *Limiter, limits map[string]Limit) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		limit, ok := limits[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+		userReq, ok := req.(userIdentified)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		allowed, retryAfter, err := limiter.Allow(ctx, bucketKey(userReq.GetUserId(), info.FullMethod), limit.Rate, limit.Burst)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "rate limit check failed")
+		}
+		if !allowed {
+			return nil, exhaustedError(retryAfter)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rate limits streaming RPCs per (user_id, method).
+// The request message for a server-streaming RPC isn't available to the
+// interceptor directly, so it wraps the ServerStream and checks the limit
+// on the first RecvMsg, once the handler has decoded its request.
+func StreamServerInterceptor(limiter *Limiter, limits map[string]Limit) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		limit, ok := limits[info.FullMethod]
+		if !ok {
+			return handler(srv, ss)
+		}
+
+		return handler(srv, &rateLimitedStream{
+			ServerStream: ss,
+			limiter:      limiter,
+			method:       info.FullMethod,
+			limit:        limit,
+		})
+	}
+}
+
+type rateLimitedStream struct {
+	grpc.ServerStream
+	limiter *Limiter
+	method  string
+	limit   Limit
+	checked bool
+}
+
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.checked {
+		return nil
+	}
+	s.checked = true
+
+	userReq, ok := m.(userIdentified)
+	if !ok {
+		return nil
+	}
+
+	allowed, retryAfter, err := s.limiter.Allow(s.Context(), bucketKey(userReq.GetUserId(), s.method), s.limit.Rate, s.limit.Burst)
+	if err != nil {
+		return status.Error(codes.Internal, "rate limit check failed")
+	}
+	if !allowed {
+		return exhaustedError(retryAfter)
+	}
+	return nil
+}
+
+// bucketKey scopes a token bucket to one user and method, matching the
+// repo's room-key convention of a fixed prefix plus a colon-joined ID.
+func bucketKey(userID, fullMethod string) string {
+	return "ratelimit:" + userID + ":" + fullMethod
+}
+
+// exhaustedError builds the ResourceExhausted status a client is expected
+// to back off on, with a RetryInfo detail carrying how long to wait.
+func exhaustedError(retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	withDetails, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
@@ -0,0 +1,108 @@
+// Package ratelimit implements a Redis-backed token bucket rate limiter
+// and the gRPC interceptors that enforce it per (user_id, method).
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBucketScript atomically refills and debits a token bucket stored in
+// a Redis hash, using Redis's own clock (via TIME) so limiter state stays
+// consistent across app instances regardless of their local clock skew.
+// go-redis's Script.Run issues EVALSHA and transparently falls back to
+// EVAL (reloading the script) on a NOSCRIPT error, so callers never need
+// to manage the script cache themselves.
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', key, 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1])
+local updated_at = tonumber(bucket[2])
+if tokens == nil then
+	tokens = burst
+	updated_at = now
+end
+
+local elapsed = math.max(0, now - updated_at)
+tokens = math.min(burst, tokens + elapsed * rate)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= requested then
+	tokens = tokens - requested
+	allowed = 1
+else
+	retry_after = (requested - tokens) / rate
+end
+
+redis.call('HMSET', key, 'tokens', tokens, 'updated_at', now)
+redis.call('EXPIRE', key, ttl)
+
+return {allowed, tostring(retry_after)}
+`)
+
+// Limiter enforces token bucket limits backed by Redis, so the limit is
+// shared across every server instance rather than held in process memory.
+type Limiter struct {
+	rdb redis.UniversalClient
+}
+
+// NewLimiter creates a Limiter backed by rdb.
+func NewLimiter(rdb redis.UniversalClient) *Limiter {
+	return &Limiter{rdb: rdb}
+}
+
+// Allow debits one token from the bucket identified by key, refilling it
+// at rate tokens/sec up to a capacity of burst tokens. It reports whether
+// the request is allowed and, if not, how long the caller should wait
+// before retrying.
+func (l *Limiter) Allow(ctx context.Context, key string, rate float64, burst int) (allowed bool, retryAfter time.Duration, err error) {
+	// Keep idle buckets around long enough to outlast a full refill, plus
+	// slack, so a bursty-then-quiet caller doesn't reset to a full bucket
+	// the moment Redis evicts the key.
+	ttlSeconds := int(math.Ceil(float64(burst)/rate)) * 2
+	if ttlSeconds < 60 {
+		ttlSeconds = 60
+	}
+
+	res, err := tokenBucketScript.Run(ctx, l.rdb, []string{key}, rate, burst, 1, ttlSeconds).Result()
+	if err != nil {
+		return false, 0, fmt.Errorf("evaluating token bucket script: %w", err)
+	}
+
+	fields, ok := res.([]interface{})
+	if !ok || len(fields) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket script result: %v", res)
+	}
+
+	allowedInt, ok := fields[0].(int64)
+	if !ok {
+		return false, 0, fmt.Errorf("unexpected token bucket allowed value: %v", fields[0])
+	}
+	retryAfterSecs, ok := fields[1].(string)
+	if !ok {
+		return false, 0, fmt.Errorf("unexpected token bucket retry_after value: %v", fields[1])
+	}
+
+	if allowedInt == 1 {
+		return true, 0, nil
+	}
+
+	var retrySecs float64
+	if _, err := fmt.Sscanf(retryAfterSecs, "%g", &retrySecs); err != nil {
+		return false, 0, fmt.Errorf("parsing retry_after: %w", err)
+	}
+	return false, time.Duration(retrySecs * float64(time.Second)), nil
+}
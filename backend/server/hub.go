@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chatcloud/backend/proto"
+)
+
+// roomHub owns exactly one Redis pubsub subscription per room and fans
+// decoded events out to every listener registered on that room, so
+// StreamMessages/StreamEvents calls no longer each open their own
+// subscription. This keeps Redis connection count at O(rooms) instead of
+// O(users) and lets go-redis's own reconnect logic in pubsub.Channel()
+// carry subscribers through transient network errors, rather than
+// bounding the subscription with an arbitrary timeout.
+type roomHub struct {
+	rdb redis.UniversalClient
+
+	// hydrate loads a message (with current edit/delete state and
+	// reactions applied) by ID, so a new-message or update notification
+	// can be turned into a full Event. Bound to ChatCloudServer.getMessage.
+	hydrate func(ctx context.Context, roomID, messageID string) (*proto.Message, error)
+
+	mu    sync.RWMutex
+	rooms map[string]*roomSubscription
+}
+
+// roomSubscription is the shared Redis subscription for one room, plus the
+// per-user channels currently listening on it. It covers both the
+// messages channel (new chat messages) and the events channel (typing,
+// ack), so one goroutine and one Redis connection serve all of it.
+type roomSubscription struct {
+	pubsub      *redis.PubSub
+	cancel      context.CancelFunc
+	subscribers map[string]chan *proto.Event
+	refCount    int
+}
+
+func newRoomHub(rdb redis.UniversalClient, hydrate func(ctx context.Context, roomID, messageID string) (*proto.Message, error)) *roomHub {
+	return &roomHub{rdb: rdb, hydrate: hydrate, rooms: make(map[string]*roomSubscription)}
+}
+
+// Subscribe registers userID as a listener on roomID, starting the room's
+// shared Redis subscription if userID is the first listener. It returns a
+// channel of events (new messages, typing, acks) and a release func the
+// caller must invoke (typically via defer) once it stops listening; the
+// shared subscription is closed automatically once its last listener
+// releases. A userID that already has an active listener on roomID (e.g.
+// a second StreamMessages call from the same client) is rejected with
+// codes.AlreadyExists rather than displacing the existing one, so a
+// client can't multiply its own fan-out by opening duplicate streams.
+func (h *roomHub) Subscribe(roomID, userID string) (<-chan *proto.Event, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.rooms[roomID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		sub = &roomSubscription{
+			pubsub:      h.rdb.Subscribe(ctx, messagesChannel(roomID), eventsChannel(roomID)),
+			cancel:      cancel,
+			subscribers: make(map[string]chan *proto.Event),
+		}
+		h.rooms[roomID] = sub
+		go h.fanOut(roomID, sub)
+	}
+
+	if _, exists := sub.subscribers[userID]; exists {
+		return nil, nil, status.Error(codes.AlreadyExists, "user already has an active stream in this room")
+	}
+
+	eventChan := make(chan *proto.Event, 200)
+	sub.subscribers[userID] = eventChan
+	sub.refCount++
+
+	return eventChan, func() { h.unsubscribe(roomID, userID, eventChan) }, nil
+}
+
+// Kick forcibly disconnects userID's listener on roomID, if any, so that a
+// StreamMessages/StreamEvents call driven out by LeaveRoom exits promptly
+// rather than waiting on the client to notice.
+func (h *roomHub) Kick(roomID, userID string) {
+	h.unsubscribe(roomID, userID, nil)
+}
+
+// unsubscribe removes userID's listener on roomID and closes its channel,
+// tearing down the room's shared subscription once the last listener is
+// gone. If expected is non-nil, the channel is only removed if it's still
+// the one currently registered, which makes Subscribe's release func safe
+// to call after a concurrent Kick (or replacement) has already done so.
+func (h *roomHub) unsubscribe(roomID, userID string, expected chan *proto.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	current, ok := sub.subscribers[userID]
+	if !ok || (expected != nil && current != expected) {
+		return
+	}
+
+	delete(sub.subscribers, userID)
+	close(current)
+	sub.refCount--
+
+	if sub.refCount == 0 {
+		delete(h.rooms, roomID)
+		sub.cancel()
+		sub.pubsub.Close()
+	}
+}
+
+// fanOut reads the room's shared Redis pubsub channels and delivers the
+// decoded event to every subscriber currently registered on the room. It
+// exits once the room's subscription is closed.
+func (h *roomHub) fanOut(roomID string, sub *roomSubscription) {
+	for rawMsg := range sub.pubsub.Channel() {
+		var event *proto.Event
+		switch rawMsg.Channel {
+		case messagesChannel(roomID):
+			event = h.messageEvent(roomID, rawMsg.Payload)
+		case eventsChannel(roomID):
+			event = h.decodeRoomEvent(roomID, rawMsg.Payload)
+		default:
+			log.Printf("Unexpected pubsub channel %s for room %s", rawMsg.Channel, roomID)
+		}
+		if event == nil {
+			continue
+		}
+
+		h.mu.RLock()
+		for _, eventChan := range sub.subscribers {
+			select {
+			case eventChan <- event:
+			default:
+				log.Printf("Channel full for a subscriber in room %s, dropping event", roomID)
+			}
+		}
+		h.mu.RUnlock()
+	}
+}
+
+// messageEvent hydrates a published stream ID into a full Message and
+// wraps it as a message Event.
+func (h *roomHub) messageEvent(roomID, msgID string) *proto.Event {
+	msg, err := h.hydrate(context.Background(), roomID, msgID)
+	if err != nil {
+		log.Printf("Error hydrating message %s in room %s: %v", msgID, roomID, err)
+		return nil
+	}
+	return &proto.Event{Payload: &proto.Event_Message{Message: msg}}
+}
+
+// decodeRoomEvent decodes a roomEvent envelope published on the events
+// channel into the matching Event oneof variant. An "update" event re-reads
+// and re-wraps the message so edits/deletes/reactions reach subscribers the
+// same way a new message does.
+func (h *roomHub) decodeRoomEvent(roomID, raw string) *proto.Event {
+	var ev roomEvent
+	if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+		log.Printf("Error decoding room event for room %s: %v", roomID, err)
+		return nil
+	}
+
+	switch ev.Type {
+	case "typing":
+		return &proto.Event{Payload: &proto.Event_Typing{
+			Typing: &proto.TypingEvent{UserId: ev.UserID, RoomId: roomID},
+		}}
+	case "ack":
+		return &proto.Event{Payload: &proto.Event_Ack{
+			Ack: &proto.AckEvent{UserId: ev.UserID, RoomId: roomID, MessageId: ev.MessageID},
+		}}
+	case "presence":
+		return &proto.Event{Payload: &proto.Event_Presence{
+			Presence: &proto.PresenceEvent{UserId: ev.UserID, RoomId: roomID, Online: ev.Online},
+		}}
+	case "update":
+		return h.messageEvent(roomID, ev.MessageID)
+	default:
+		log.Printf("Unknown room event type %q for room %s", ev.Type, roomID)
+		return nil
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+// roomKey returns a room-scoped Redis key, hash-tagging it by room ID so
+// that all of a room's keys land on the same Redis Cluster slot. That
+// lets multi-key operations and the room's pubsub subscribers stay
+// cluster-local instead of fanning out across the keyspace.
+func roomKey(roomID, suffix string) string {
+	return "{room:" + roomID + "}:" + suffix
+}
+
+// usersKey returns the set of user IDs currently in roomID.
+func usersKey(roomID string) string {
+	return roomKey(roomID, "users")
+}
+
+// messagesChannel returns the pubsub channel SendMessage publishes new
+// stream IDs on, distinct from the events channel used by presence,
+// typing, and read receipts.
+func messagesChannel(roomID string) string {
+	return roomKey(roomID, "messages")
+}
+
+// eventsChannel returns the pubsub channel typing and ack events are
+// published on, alongside the messages channel.
+func eventsChannel(roomID string) string {
+	return roomKey(roomID, "events")
+}
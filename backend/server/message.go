@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chatcloud/backend/proto"
+)
+
+// maxEditHistory caps how many previous revisions EditMessage retains per
+// message.
+const maxEditHistory = 20
+
+// maxMessageContentLength caps how large a single message's content can
+// be, so a single SendMessage call can't bloat the stream or fan-out.
+const maxMessageContentLength = 4000
+
+// messageStateKey, messageReactionsKey, and messageHistoryKey are scoped by
+// room because a message ID is a Redis Stream entry ID, unique only within
+// its own room's stream: two rooms can legitimately mint the same ID.
+func messageStateKey(roomID, messageID string) string {
+	return roomKey(roomID, "message:"+messageID+":state")
+}
+
+func messageReactionsKey(roomID, messageID string) string {
+	return roomKey(roomID, "message:"+messageID+":reactions")
+}
+
+func messageHistoryKey(roomID, messageID string) string {
+	return roomKey(roomID, "message:"+messageID+":history")
+}
+
+// getMessage fetches a message's immutable stream entry and overlays any
+// edit/delete state and reactions recorded since.
+func (s *ChatCloudServer) getMessage(ctx context.Context, roomID, messageID string) (*proto.Message, error) {
+	entries, err := s.rdb.XRange(ctx, streamKey(roomID), messageID, messageID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, status.Error(codes.NotFound, "message not found")
+	}
+
+	msg, err := decodeStreamMessage(roomID, entries[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.applyMessageState(ctx, msg); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// applyMessageState overlays msg with any edit/delete recorded in its
+// state hash.
+func (s *ChatCloudServer) applyMessageState(ctx context.Context, msg *proto.Message) error {
+	state, err := s.rdb.HGetAll(ctx, messageStateKey(msg.RoomId, msg.Id)).Result()
+	if err != nil {
+		return err
+	}
+
+	if deleted, _ := strconv.ParseBool(state["deleted"]); deleted {
+		msg.Deleted = true
+		msg.Content = ""
+		return nil
+	}
+	if content, ok := state["content"]; ok {
+		msg.Content = content
+	}
+	if editedAt, ok := state["edited_at"]; ok {
+		if ms, err := strconv.ParseInt(editedAt, 10, 64); err == nil {
+			msg.EditedAt = ms
+		}
+	}
+	return nil
+}
+
+// attachReactions populates msg.Reactions from its companion reactions
+// hash (emoji -> JSON-encoded user ID list).
+func (s *ChatCloudServer) attachReactions(ctx context.Context, msg *proto.Message) error {
+	raw, err := s.rdb.HGetAll(ctx, messageReactionsKey(msg.RoomId, msg.Id)).Result()
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	reactions := make([]*proto.Reaction, 0, len(raw))
+	for emoji, encoded := range raw {
+		var userIDs []string
+		if err := json.Unmarshal([]byte(encoded), &userIDs); err != nil {
+			log.Printf("Error decoding reaction %s on message %s: %v", emoji, msg.Id, err)
+			continue
+		}
+		if len(userIDs) == 0 {
+			continue
+		}
+		reactions = append(reactions, &proto.Reaction{Emoji: emoji, UserIds: userIDs})
+	}
+	msg.Reactions = reactions
+	return nil
+}
+
+// hydrateMessages overlays edit/delete state and reactions onto a page of
+// messages returned by a MessageIterator.
+func (s *ChatCloudServer) hydrateMessages(ctx context.Context, messages []*proto.Message) error {
+	for _, msg := range messages {
+		if err := s.applyMessageState(ctx, msg); err != nil {
+			return err
+		}
+		if err := s.attachReactions(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EditMessage updates a message's content; only the original author may
+// call it. The previous content is retained in a capped edit history.
+func (s *ChatCloudServer) EditMessage(ctx context.Context, req *proto.EditMessageRequest) (*proto.EditMessageResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if req.GetMessageId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+	if req.GetNewContent() == "" {
+		return nil, status.Error(codes.InvalidArgument, "new_content is required")
+	}
+	if len(req.GetNewContent()) > maxMessageContentLength {
+		return nil, status.Error(codes.InvalidArgument, "new_content exceeds maximum length")
+	}
+
+	msg, err := s.getMessage(ctx, req.GetRoomId(), req.GetMessageId())
+	if err != nil {
+		log.Printf("Error loading message to edit: %v", err)
+		if st, ok := status.FromError(err); ok {
+			return nil, st.Err()
+		}
+		return nil, status.Error(codes.Internal, "failed to load message")
+	}
+	if msg.Deleted {
+		return nil, status.Error(codes.FailedPrecondition, "message has been deleted")
+	}
+	if msg.UserId != req.GetUserId() {
+		return nil, status.Error(codes.PermissionDenied, "only the author can edit this message")
+	}
+
+	if err := s.pushEditHistory(ctx, req.GetRoomId(), req.GetMessageId(), msg.Content); err != nil {
+		log.Printf("Error recording edit history: %v", err)
+	}
+
+	now := nowMillis()
+	err = s.rdb.HSet(ctx, messageStateKey(req.GetRoomId(), req.GetMessageId()), map[string]interface{}{
+		"content":   req.GetNewContent(),
+		"edited_at": now,
+	}).Err()
+	if err != nil {
+		log.Printf("Error storing message edit: %v", err)
+		return nil, status.Error(codes.Internal, "failed to edit message")
+	}
+
+	msg.Content = req.GetNewContent()
+	msg.EditedAt = now
+
+	if err := s.publishUpdateEvent(ctx, req.GetRoomId(), req.GetMessageId()); err != nil {
+		log.Printf("Error publishing update event: %v", err)
+	}
+
+	return &proto.EditMessageResponse{Success: true, Message: msg}, nil
+}
+
+// pushEditHistory records previousContent as the newest entry in the
+// message's edit history, trimming it to maxEditHistory entries.
+func (s *ChatCloudServer) pushEditHistory(ctx context.Context, roomID, messageID, previousContent string) error {
+	key := messageHistoryKey(roomID, messageID)
+	if err := s.rdb.RPush(ctx, key, previousContent).Err(); err != nil {
+		return err
+	}
+	return s.rdb.LTrim(ctx, key, -maxEditHistory, -1).Err()
+}
+
+// DeleteMessage soft-deletes a message; only the original author may call
+// it. Content is cleared but the stream entry itself is left in place so
+// ordering and cursors are unaffected.
+func (s *ChatCloudServer) DeleteMessage(ctx context.Context, req *proto.DeleteMessageRequest) (*proto.DeleteMessageResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if req.GetMessageId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+
+	msg, err := s.getMessage(ctx, req.GetRoomId(), req.GetMessageId())
+	if err != nil {
+		log.Printf("Error loading message to delete: %v", err)
+		if st, ok := status.FromError(err); ok {
+			return nil, st.Err()
+		}
+		return nil, status.Error(codes.Internal, "failed to load message")
+	}
+	if msg.UserId != req.GetUserId() {
+		return nil, status.Error(codes.PermissionDenied, "only the author can delete this message")
+	}
+
+	err = s.rdb.HSet(ctx, messageStateKey(req.GetRoomId(), req.GetMessageId()), map[string]interface{}{
+		"deleted": true,
+	}).Err()
+	if err != nil {
+		log.Printf("Error deleting message: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete message")
+	}
+
+	if err := s.publishUpdateEvent(ctx, req.GetRoomId(), req.GetMessageId()); err != nil {
+		log.Printf("Error publishing update event: %v", err)
+	}
+
+	return &proto.DeleteMessageResponse{Success: true}, nil
+}
+
+// React adds or removes user_id's reaction to a message.
+func (s *ChatCloudServer) React(ctx context.Context, req *proto.ReactRequest) (*proto.ReactResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if req.GetMessageId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+	if req.GetEmoji() == "" {
+		return nil, status.Error(codes.InvalidArgument, "emoji is required")
+	}
+
+	if err := s.updateReaction(ctx, req.GetRoomId(), req.GetMessageId(), req.GetEmoji(), req.GetUserId(), req.GetAction()); err != nil {
+		log.Printf("Error updating reaction: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update reaction")
+	}
+
+	msg, err := s.getMessage(ctx, req.GetRoomId(), req.GetMessageId())
+	if err != nil {
+		log.Printf("Error loading reacted-to message: %v", err)
+		if st, ok := status.FromError(err); ok {
+			return nil, st.Err()
+		}
+		return nil, status.Error(codes.Internal, "failed to load message")
+	}
+
+	if err := s.publishUpdateEvent(ctx, req.GetRoomId(), req.GetMessageId()); err != nil {
+		log.Printf("Error publishing update event: %v", err)
+	}
+
+	return &proto.ReactResponse{Success: true, Message: msg}, nil
+}
+
+// updateReactionScript atomically adds or removes a user from the
+// JSON-encoded user ID list stored in a reactions hash field, so two users
+// reacting with the same emoji at the same time can't race a plain
+// HGET-then-HSET and silently drop one of the updates, the same concern
+// ratelimit.tokenBucketScript addresses for token buckets.
+var updateReactionScript = redis.NewScript(`
+local key = KEYS[1]
+local emoji = ARGV[1]
+local user_id = ARGV[2]
+local remove = ARGV[3] == '1'
+
+local raw = redis.call('HGET', key, emoji)
+local user_ids = {}
+if raw then
+	user_ids = cjson.decode(raw)
+end
+
+local idx = nil
+for i, id in ipairs(user_ids) do
+	if id == user_id then
+		idx = i
+		break
+	end
+end
+
+if remove then
+	if idx ~= nil then
+		table.remove(user_ids, idx)
+	end
+elseif idx == nil then
+	table.insert(user_ids, user_id)
+end
+
+if #user_ids == 0 then
+	redis.call('HDEL', key, emoji)
+else
+	redis.call('HSET', key, emoji, cjson.encode(user_ids))
+end
+
+return #user_ids
+`)
+
+// updateReaction adds or removes userID from the set of users reacting
+// with emoji on messageID, stored as a JSON-encoded array in the
+// message's reactions hash. The read-modify-write happens atomically in
+// Lua so concurrent reacts on the same emoji can't lose an update.
+func (s *ChatCloudServer) updateReaction(ctx context.Context, roomID, messageID, emoji, userID string, action proto.ReactionAction) error {
+	key := messageReactionsKey(roomID, messageID)
+	remove := "0"
+	if action == proto.ReactionAction_REACTION_REMOVE {
+		remove = "1"
+	}
+	return updateReactionScript.Run(ctx, s.rdb, []string{key}, emoji, userID, remove).Err()
+}
+
+// publishUpdateEvent publishes a synthetic "update" event for messageID so
+// the room's hub re-fetches it and re-sends its current state to every
+// StreamMessages and StreamEvents subscriber.
+func (s *ChatCloudServer) publishUpdateEvent(ctx context.Context, roomID, messageID string) error {
+	return s.publishRoomEvent(ctx, roomID, roomEvent{Type: "update", MessageID: messageID})
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chatcloud/backend/proto"
+)
+
+// presenceTTL is how recently a Heartbeat must have landed for ListPresent
+// to still count a user as present; older entries are lazily pruned.
+const presenceTTL = 30 * time.Second
+
+// typingTTL bounds how long a single SendTyping call debounces further
+// typing events for the same user, so a client can call it on every
+// keystroke without flooding the room.
+const typingTTL = 5 * time.Second
+
+// presenceKey returns the sorted set tracking each room member's last
+// heartbeat time, scored by millisecond timestamp.
+func presenceKey(roomID string) string {
+	return roomKey(roomID, "presence")
+}
+
+// readsKey returns the hash mapping user ID to the last stream ID they
+// have acknowledged reading in roomID.
+func readsKey(roomID string) string {
+	return roomKey(roomID, "reads")
+}
+
+// typingKey returns the debounce key for userID's typing indicator in
+// roomID.
+func typingKey(roomID, userID string) string {
+	return roomKey(roomID, "typing:"+userID)
+}
+
+// roomEvent is the JSON envelope published on a room's events channel;
+// the hub's fan-out decodes it back into the matching Event oneof variant.
+type roomEvent struct {
+	Type      string `json:"type"`
+	UserID    string `json:"user_id"`
+	MessageID string `json:"message_id,omitempty"`
+	Online    bool   `json:"online,omitempty"`
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Heartbeat marks user_id as currently present in room_id. ZAdd's return
+// value is the number of members it newly added (score-only updates on an
+// existing member don't count). Entries older than presenceTTL are pruned
+// first, so a result of 1 means this is the user's first heartbeat since
+// going absent and a PresenceEvent is published.
+func (s *ChatCloudServer) Heartbeat(ctx context.Context, req *proto.HeartbeatRequest) (*proto.HeartbeatResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	key := presenceKey(req.GetRoomId())
+	now := nowMillis()
+	cutoff := strconv.FormatInt(now-presenceTTL.Milliseconds(), 10)
+	if err := s.rdb.ZRemRangeByScore(ctx, key, "-inf", "("+cutoff).Err(); err != nil {
+		log.Printf("Error pruning stale presence: %v", err)
+	}
+
+	added, err := s.rdb.ZAdd(ctx, key, &redis.Z{
+		Score:  float64(now),
+		Member: req.GetUserId(),
+	}).Result()
+	if err != nil {
+		log.Printf("Error recording heartbeat: %v", err)
+		return nil, status.Error(codes.Internal, "failed to record heartbeat")
+	}
+
+	if added > 0 {
+		ev := roomEvent{Type: "presence", UserID: req.GetUserId(), Online: true}
+		if err := s.publishRoomEvent(ctx, req.GetRoomId(), ev); err != nil {
+			log.Printf("Error publishing presence event: %v", err)
+		}
+	}
+
+	return &proto.HeartbeatResponse{Success: true}, nil
+}
+
+// ListPresent returns the room_id members with a heartbeat newer than
+// presenceTTL, pruning older entries first.
+func (s *ChatCloudServer) ListPresent(ctx context.Context, req *proto.ListPresentRequest) (*proto.ListPresentResponse, error) {
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	key := presenceKey(req.GetRoomId())
+	cutoff := strconv.FormatInt(nowMillis()-presenceTTL.Milliseconds(), 10)
+
+	if err := s.rdb.ZRemRangeByScore(ctx, key, "-inf", "("+cutoff).Err(); err != nil {
+		log.Printf("Error pruning stale presence: %v", err)
+	}
+
+	userIDs, err := s.rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: cutoff, Max: "+inf"}).Result()
+	if err != nil {
+		log.Printf("Error listing present users: %v", err)
+		return nil, status.Error(codes.Internal, "failed to list present users")
+	}
+
+	return &proto.ListPresentResponse{UserIds: userIDs}, nil
+}
+
+// SendTyping publishes a typing indicator for user_id in room_id, debounced
+// by typingTTL so a client can call it on every keystroke.
+func (s *ChatCloudServer) SendTyping(ctx context.Context, req *proto.SendTypingRequest) (*proto.SendTypingResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	published, err := s.rdb.SetNX(ctx, typingKey(req.GetRoomId(), req.GetUserId()), "1", typingTTL).Result()
+	if err != nil {
+		log.Printf("Error setting typing debounce key: %v", err)
+		return nil, status.Error(codes.Internal, "failed to send typing indicator")
+	}
+	if !published {
+		// Already published within the debounce window
+		return &proto.SendTypingResponse{Success: true}, nil
+	}
+
+	if err := s.publishRoomEvent(ctx, req.GetRoomId(), roomEvent{Type: "typing", UserID: req.GetUserId()}); err != nil {
+		log.Printf("Error publishing typing event: %v", err)
+	}
+
+	return &proto.SendTypingResponse{Success: true}, nil
+}
+
+// Ack records the last message user_id has read in room_id and publishes
+// a read-receipt event.
+func (s *ChatCloudServer) Ack(ctx context.Context, req *proto.AckRequest) (*proto.AckResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	if req.GetMessageId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "message_id is required")
+	}
+
+	err := s.rdb.HSet(ctx, readsKey(req.GetRoomId()), req.GetUserId(), req.GetMessageId()).Err()
+	if err != nil {
+		log.Printf("Error recording read receipt: %v", err)
+		return nil, status.Error(codes.Internal, "failed to record read receipt")
+	}
+
+	ev := roomEvent{Type: "ack", UserID: req.GetUserId(), MessageID: req.GetMessageId()}
+	if err := s.publishRoomEvent(ctx, req.GetRoomId(), ev); err != nil {
+		log.Printf("Error publishing ack event: %v", err)
+	}
+
+	return &proto.AckResponse{Success: true}, nil
+}
+
+// publishRoomEvent JSON-encodes ev and publishes it on room_id's events
+// channel, where every room subscriber's fan-out goroutine picks it up.
+func (s *ChatCloudServer) publishRoomEvent(ctx context.Context, roomID string, ev roomEvent) error {
+	encoded, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Publish(ctx, eventsChannel(roomID), encoded).Err()
+}
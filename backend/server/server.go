@@ -2,13 +2,11 @@ package server
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -20,17 +18,15 @@ type ChatCloudServer struct {
 	// UnimplementedChatCloudServer must be embedded to have forward compatible implementations
 	proto.UnimplementedChatCloudServer
 
-	rdb           *redis.Client
-	roomStreams   map[string]map[string]chan *proto.Message
-	roomStreamsMu sync.RWMutex
+	rdb redis.UniversalClient
+	hub *roomHub
 }
 
 // NewChatCloudServer creates a new ChatCloudServer
-func NewChatCloudServer(rdb *redis.Client) *ChatCloudServer {
-	return &ChatCloudServer{
-		rdb:         rdb,
-		roomStreams: make(map[string]map[string]chan *proto.Message),
-	}
+func NewChatCloudServer(rdb redis.UniversalClient) *ChatCloudServer {
+	s := &ChatCloudServer{rdb: rdb}
+	s.hub = newRoomHub(rdb, s.getMessage)
+	return s
 }
 
 // JoinRoom allows a user to join a chat room
@@ -43,7 +39,7 @@ func (s *ChatCloudServer) JoinRoom(ctx context.Context, req *proto.JoinRoomReque
 	}
 
 	// Add user to room in Redis
-	err := s.rdb.SAdd(ctx, "room:"+req.GetRoomId()+":users", req.GetUserId()).Err()
+	err := s.rdb.SAdd(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Err()
 	if err != nil {
 		log.Printf("Error adding user to room: %v", err)
 		return nil, status.Error(codes.Internal, "failed to join room")
@@ -56,37 +52,15 @@ func (s *ChatCloudServer) JoinRoom(ctx context.Context, req *proto.JoinRoomReque
 		return nil, status.Error(codes.Internal, "failed to join room")
 	}
 
-	// Get recent messages from Redis
-	messageIDs, err := s.rdb.LRange(ctx, "room:"+req.GetRoomId()+":messages", 0, 49).Result()
+	// Get the latest N messages from the room's stream, newest first
+	recentMessages, _, err := newMessageIterator(s.rdb, req.GetRoomId(), true).Page(ctx, "", 50)
 	if err != nil {
 		log.Printf("Error getting recent messages: %v", err)
 		return nil, status.Error(codes.Internal, "failed to get recent messages")
 	}
-
-	// Fetch message details for each message ID
-	var recentMessages []*proto.Message
-	for _, msgID := range messageIDs {
-		msgMap, err := s.rdb.HGetAll(ctx, "message:"+msgID).Result()
-		if err != nil {
-			log.Printf("Error getting message details: %v", err)
-			continue
-		}
-
-		// Parse timestamp
-		timestamp, err := time.Parse(time.RFC3339, msgMap["timestamp"])
-		if err != nil {
-			log.Printf("Error parsing timestamp: %v", err)
-			continue
-		}
-
-		msg := &proto.Message{
-			Id:        msgID,
-			UserId:    msgMap["user_id"],
-			RoomId:    msgMap["room_id"],
-			Content:   msgMap["content"],
-			Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
-		}
-		recentMessages = append(recentMessages, msg)
+	if err := s.hydrateMessages(ctx, recentMessages); err != nil {
+		log.Printf("Error hydrating recent messages: %v", err)
+		return nil, status.Error(codes.Internal, "failed to get recent messages")
 	}
 
 	return &proto.JoinRoomResponse{
@@ -95,6 +69,61 @@ func (s *ChatCloudServer) JoinRoom(ctx context.Context, req *proto.JoinRoomReque
 	}, nil
 }
 
+// GetHistory returns a page of a room's message history. Pass before_id to
+// page backwards into older messages (using the previous response's
+// next_cursor), or after_id to page forwards into newer ones; the two are
+// mutually exclusive. Omitting both returns the most recent page.
+func (s *ChatCloudServer) GetHistory(ctx context.Context, req *proto.GetHistoryRequest) (*proto.GetHistoryResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	// Check if user is in the room, same as SendMessage/StreamMessages, so
+	// history can't be paged through by anyone who merely knows the room_id
+	isMember, err := s.rdb.SIsMember(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Result()
+	if err != nil {
+		log.Printf("Error checking if user is in room: %v", err)
+		return nil, status.Error(codes.Internal, "failed to get history")
+	}
+	if !isMember {
+		return nil, status.Error(codes.PermissionDenied, "user is not in the room")
+	}
+
+	if req.GetBeforeId() != "" && req.GetAfterId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "before_id and after_id are mutually exclusive")
+	}
+
+	limit := int64(req.GetLimit())
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	reverse := req.GetAfterId() == ""
+	cursor := req.GetBeforeId()
+	if !reverse {
+		cursor = req.GetAfterId()
+	}
+
+	messages, next, err := newMessageIterator(s.rdb, req.GetRoomId(), reverse).Page(ctx, cursor, limit)
+	if err != nil {
+		log.Printf("Error getting message history: %v", err)
+		return nil, status.Error(codes.Internal, "failed to get history")
+	}
+	if err := s.hydrateMessages(ctx, messages); err != nil {
+		log.Printf("Error hydrating message history: %v", err)
+		return nil, status.Error(codes.Internal, "failed to get history")
+	}
+
+	resp := &proto.GetHistoryResponse{Messages: messages}
+	if int64(len(messages)) == limit {
+		resp.NextCursor = next
+	}
+	return resp, nil
+}
+
 // SendMessage allows a user to send a message to a room
 func (s *ChatCloudServer) SendMessage(ctx context.Context, req *proto.SendMessageRequest) (*proto.SendMessageResponse, error) {
 	if req.GetUserId() == "" {
@@ -106,9 +135,12 @@ func (s *ChatCloudServer) SendMessage(ctx context.Context, req *proto.SendMessag
 	if req.GetContent() == "" {
 		return nil, status.Error(codes.InvalidArgument, "content is required")
 	}
+	if len(req.GetContent()) > maxMessageContentLength {
+		return nil, status.Error(codes.InvalidArgument, "content exceeds maximum length")
+	}
 
 	// Check if user is in the room
-	isMember, err := s.rdb.SIsMember(ctx, "room:"+req.GetRoomId()+":users", req.GetUserId()).Result()
+	isMember, err := s.rdb.SIsMember(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Result()
 	if err != nil {
 		log.Printf("Error checking if user is in room: %v", err)
 		return nil, status.Error(codes.Internal, "failed to send message")
@@ -117,51 +149,48 @@ func (s *ChatCloudServer) SendMessage(ctx context.Context, req *proto.SendMessag
 		return nil, status.Error(codes.PermissionDenied, "user is not in the room")
 	}
 
-	// Create message
-	msgID := uuid.New().String()
-	now := time.Now()
-	msg := &proto.Message{
-		Id:        msgID,
-		UserId:    req.GetUserId(),
-		RoomId:    req.GetRoomId(),
+	// Encode the message body as a single JSON field so future fields
+	// (metadata, edits, reactions, ...) don't require a stream schema change
+	encoded, err := json.Marshal(streamMessagePayload{
+		UserID:    req.GetUserId(),
 		Content:   req.GetContent(),
-		Timestamp: now.UnixNano() / int64(time.Millisecond),
-	}
-
-	// Store message in Redis
-	_, err = s.rdb.HSet(ctx, "message:"+msgID, map[string]interface{}{
-		"user_id":   req.GetUserId(),
-		"room_id":   req.GetRoomId(),
-		"content":   req.GetContent(),
-		"timestamp": now.Format(time.RFC3339),
-	}).Result()
+		ReplyToID: req.GetReplyToId(),
+	})
 	if err != nil {
-		log.Printf("Error storing message: %v", err)
+		log.Printf("Error encoding message: %v", err)
 		return nil, status.Error(codes.Internal, "failed to send message")
 	}
 
-	// Add message ID to room's message list
-	err = s.rdb.LPush(ctx, "room:"+req.GetRoomId()+":messages", msgID).Err()
+	// Append to the room's stream; the returned ID is a monotonic,
+	// time-encoded message ID. Approximate trimming keeps the stream
+	// around 1000 entries without an O(n) exact trim on every write.
+	streamID, err := s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(req.GetRoomId()),
+		MaxLen: 1000,
+		Approx: true,
+		Values: map[string]interface{}{"json": encoded},
+	}).Result()
 	if err != nil {
-		log.Printf("Error adding message to room: %v", err)
+		log.Printf("Error storing message: %v", err)
 		return nil, status.Error(codes.Internal, "failed to send message")
 	}
 
-	// Trim message list to keep only the most recent 1000 messages
-	err = s.rdb.LTrim(ctx, "room:"+req.GetRoomId()+":messages", 0, 999).Err()
-	if err != nil {
-		log.Printf("Error trimming message list: %v", err)
+	msg := &proto.Message{
+		Id:        streamID,
+		UserId:    req.GetUserId(),
+		RoomId:    req.GetRoomId(),
+		Content:   req.GetContent(),
+		ReplyToId: req.GetReplyToId(),
+		Timestamp: streamIDTimestampMillis(streamID),
 	}
 
-	// Publish message to Redis channel for the room
-	err = s.rdb.Publish(ctx, "room:"+req.GetRoomId(), msgID).Err()
+	// Publish the stream ID to the room's channel so subscribers can look
+	// the message back up in the stream
+	err = s.rdb.Publish(ctx, messagesChannel(req.GetRoomId()), streamID).Err()
 	if err != nil {
 		log.Printf("Error publishing message: %v", err)
 	}
 
-	// Broadcast message to all connected clients
-	s.broadcastMessage(msg)
-
 	return &proto.SendMessageResponse{
 		Success: true,
 		Message: msg,
@@ -181,7 +210,7 @@ func (s *ChatCloudServer) StreamMessages(req *proto.StreamMessagesRequest, strea
 	ctx := stream.Context()
 
 	// Check if user is in the room
-	isMember, err := s.rdb.SIsMember(ctx, "room:"+req.GetRoomId()+":users", req.GetUserId()).Result()
+	isMember, err := s.rdb.SIsMember(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Result()
 	if err != nil {
 		log.Printf("Error checking if user is in room: %v", err)
 		return status.Error(codes.Internal, "failed to stream messages")
@@ -190,165 +219,13 @@ func (s *ChatCloudServer) StreamMessages(req *proto.StreamMessagesRequest, strea
 		return status.Error(codes.PermissionDenied, "user is not in the room")
 	}
 
-	// Create a channel for this user in this room with a larger buffer
-	msgChan := make(chan *proto.Message, 200)
-
-	// Register the stream with improved handling of existing channels
-	s.roomStreamsMu.Lock()
-	if _, ok := s.roomStreams[req.GetRoomId()]; !ok {
-		s.roomStreams[req.GetRoomId()] = make(map[string]chan *proto.Message)
-	}
-	
-	// If there's an existing channel for this user, close it safely
-	if existingChan, exists := s.roomStreams[req.GetRoomId()][req.GetUserId()]; exists {
-		log.Printf("Found existing stream for user %s in room %s, closing it safely", req.GetUserId(), req.GetRoomId())
-		// Safely close the existing channel
-		func(ch chan *proto.Message) {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Recovered from panic when closing existing channel: %v", r)
-				}
-			}()
-			// Try to close the channel only if it's not already closed
-			select {
-			case _, ok := <-ch:
-				if ok {
-					close(ch)
-				}
-			default:
-				// Try to close, but recover if it panics
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							log.Printf("Channel was already closed: %v", r)
-						}
-					}()
-					close(ch)
-				}()
-			}
-		}(existingChan)
-	}
-	
-	// Register the new channel
-	s.roomStreams[req.GetRoomId()][req.GetUserId()] = msgChan
-	log.Printf("Registered new stream for user %s in room %s", req.GetUserId(), req.GetRoomId())
-	s.roomStreamsMu.Unlock()
-
-	// Track whether the channel has been closed to avoid double-closing
-	var (closed bool = false
-	     closeMutex sync.Mutex)
-	
-	// Cleanup function to ensure proper resource release
-	cleanup := func() {
-		// Remove the user's stream from our map
-		s.roomStreamsMu.Lock()
-		delete(s.roomStreams[req.GetRoomId()], req.GetUserId())
-		if len(s.roomStreams[req.GetRoomId()]) == 0 {
-			delete(s.roomStreams, req.GetRoomId())
-		}
-		s.roomStreamsMu.Unlock()
-		
-		// Close the message channel if it's not already closed
-		closeMutex.Lock()
-		defer closeMutex.Unlock()
-		
-		if !closed {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Recovered from panic when closing channel: %v", r)
-				}
-			}()
-			
-			// Mark as closed before actually closing to prevent double-close attempts
-			closed = true
-			log.Printf("Closing message channel for user %s in room %s", req.GetUserId(), req.GetRoomId())
-			close(msgChan)
-		} else {
-			log.Printf("Channel already closed for user %s in room %s", req.GetUserId(), req.GetRoomId())
-		}
-		
-		log.Printf("Cleaned up resources for user %s in room %s", req.GetUserId(), req.GetRoomId())
-	}
-
-	// Make sure to clean up when we're done
-	defer cleanup()
-
-	// Create a separate background context for Redis subscription with a timeout
-	// This ensures that even if there's an issue, the context will eventually be cancelled
-	redisCtx, redisCancel := context.WithTimeout(context.Background(), 1*time.Hour)
-	
-	// Make sure to cancel the Redis context when we're done with the stream
-	defer func() {
-		log.Printf("Cancelling Redis context for user %s in room %s", req.GetUserId(), req.GetRoomId())
-		redisCancel()
-	}()
-	
-	// Subscribe to Redis channel for the room using the separate context
-	pubsub := s.rdb.Subscribe(redisCtx, "room:"+req.GetRoomId())
-	defer pubsub.Close()
-
-	// Start a goroutine to listen for Redis messages
-	redisErrChan := make(chan error, 1)
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Recovered from panic in Redis message handler: %v", r)
-				redisErrChan <- fmt.Errorf("redis handler panic: %v", r)
-			}
-		}()
-
-		ch := pubsub.Channel()
-		for {
-			select {
-			case <-redisCtx.Done():
-				log.Printf("Redis context cancelled, exiting Redis subscription goroutine for user %s in room %s", req.GetUserId(), req.GetRoomId())
-				return
-			case msg, ok := <-ch:
-				if !ok {
-					log.Printf("Redis subscription channel closed for user %s in room %s", req.GetUserId(), req.GetRoomId())
-					return
-				}
-
-				// Get message details using the Redis context
-				msgID := msg.Payload
-				msgMap, err := s.rdb.HGetAll(redisCtx, "message:"+msgID).Result()
-				if err != nil {
-					log.Printf("Error getting message details: %v", err)
-					continue
-				}
-
-				// Parse timestamp
-				timestamp, err := time.Parse(time.RFC3339, msgMap["timestamp"])
-				if err != nil {
-					log.Printf("Error parsing timestamp: %v", err)
-					continue
-				}
-
-				// Create the message
-				protoMsg := &proto.Message{
-					Id:        msgID,
-					UserId:    msgMap["user_id"],
-					RoomId:    msgMap["room_id"],
-					Content:   msgMap["content"],
-					Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
-				}
-
-				// Send message to the channel if it's still open
-				select {
-				case msgChan <- protoMsg:
-					// Successfully sent
-				case <-redisCtx.Done():
-					log.Printf("Redis context cancelled while sending message")
-					return
-				case <-ctx.Done():
-					log.Printf("Stream context cancelled while sending message")
-					return
-				default:
-					log.Printf("Channel full for user %s in room %s, dropping message", req.GetUserId(), req.GetRoomId())
-				}
-			}
-		}
-	}()
+	// Subscribe through the room's shared hub instead of opening a
+	// per-user Redis subscription
+	eventChan, release, err := s.hub.Subscribe(req.GetRoomId(), req.GetUserId())
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	// Set up keep-alive mechanism with shorter interval
 	keepAliveTicker := time.NewTicker(10 * time.Second)
@@ -369,20 +246,22 @@ func (s *ChatCloudServer) StreamMessages(req *proto.StreamMessagesRequest, strea
 		return err
 	}
 
-	// Main loop to process messages and keep-alives
+	// Main loop to process messages and keep-alives; typing/presence/ack
+	// events also flow through eventChan but are only relevant to StreamEvents callers
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Stream context done for user %s in room %s", req.GetUserId(), req.GetRoomId())
 			return nil
-		case err := <-redisErrChan:
-			log.Printf("Redis error for user %s in room %s: %v", req.GetUserId(), req.GetRoomId(), err)
-			return status.Error(codes.Internal, "redis subscription error")
-		case msg, ok := <-msgChan:
+		case event, ok := <-eventChan:
 			if !ok {
-				log.Printf("Message channel closed for user %s in room %s", req.GetUserId(), req.GetRoomId())
+				log.Printf("Event channel closed for user %s in room %s", req.GetUserId(), req.GetRoomId())
 				return nil
 			}
+			msg := event.GetMessage()
+			if msg == nil {
+				continue
+			}
 			if err := stream.Send(msg); err != nil {
 				log.Printf("Error sending message to user %s in room %s: %v", req.GetUserId(), req.GetRoomId(), err)
 				return err
@@ -398,6 +277,74 @@ func (s *ChatCloudServer) StreamMessages(req *proto.StreamMessagesRequest, strea
 	}
 }
 
+// StreamEvents is StreamMessages' sibling for clients that also want
+// typing indicators, presence changes, and read receipts: it delivers the
+// same new-message notifications plus typing/presence/ack events, all as
+// Event frames on one stream.
+func (s *ChatCloudServer) StreamEvents(req *proto.StreamMessagesRequest, stream proto.ChatCloud_StreamEventsServer) error {
+	if req.GetUserId() == "" {
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetRoomId() == "" {
+		return status.Error(codes.InvalidArgument, "room_id is required")
+	}
+
+	ctx := stream.Context()
+
+	isMember, err := s.rdb.SIsMember(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Result()
+	if err != nil {
+		log.Printf("Error checking if user is in room: %v", err)
+		return status.Error(codes.Internal, "failed to stream events")
+	}
+	if !isMember {
+		return status.Error(codes.PermissionDenied, "user is not in the room")
+	}
+
+	eventChan, release, err := s.hub.Subscribe(req.GetRoomId(), req.GetUserId())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	keepAliveTicker := time.NewTicker(10 * time.Second)
+	defer keepAliveTicker.Stop()
+
+	keepAliveEvent := &proto.Event{Payload: &proto.Event_Message{Message: &proto.Message{
+		Id:        "keep-alive",
+		UserId:    req.GetUserId(),
+		RoomId:    req.GetRoomId(),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}}}
+
+	if err := stream.Send(keepAliveEvent); err != nil {
+		log.Printf("Error sending initial keep-alive event: %v", err)
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Event stream context done for user %s in room %s", req.GetUserId(), req.GetRoomId())
+			return nil
+		case event, ok := <-eventChan:
+			if !ok {
+				log.Printf("Event channel closed for user %s in room %s", req.GetUserId(), req.GetRoomId())
+				return nil
+			}
+			if err := stream.Send(event); err != nil {
+				log.Printf("Error sending event to user %s in room %s: %v", req.GetUserId(), req.GetRoomId(), err)
+				return err
+			}
+		case <-keepAliveTicker.C:
+			keepAliveEvent.GetMessage().Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+			if err := stream.Send(keepAliveEvent); err != nil {
+				log.Printf("Error sending keep-alive event to user %s in room %s: %v", req.GetUserId(), req.GetRoomId(), err)
+				return err
+			}
+		}
+	}
+}
+
 // LeaveRoom allows a user to leave a chat room
 func (s *ChatCloudServer) LeaveRoom(ctx context.Context, req *proto.LeaveRoomRequest) (*proto.LeaveRoomResponse, error) {
 	if req.UserId == "" {
@@ -408,7 +355,7 @@ func (s *ChatCloudServer) LeaveRoom(ctx context.Context, req *proto.LeaveRoomReq
 	}
 
 	// Remove user from room in Redis
-	err := s.rdb.SRem(ctx, "room:"+req.GetRoomId()+":users", req.GetUserId()).Err()
+	err := s.rdb.SRem(ctx, usersKey(req.GetRoomId()), req.GetUserId()).Err()
 	if err != nil {
 		log.Printf("Error removing user from room: %v", err)
 		return nil, status.Error(codes.Internal, "failed to leave room")
@@ -421,38 +368,12 @@ func (s *ChatCloudServer) LeaveRoom(ctx context.Context, req *proto.LeaveRoomReq
 		return nil, status.Error(codes.Internal, "failed to leave room")
 	}
 
-	// Remove user's stream if it exists
-	s.roomStreamsMu.Lock()
-	if roomStreams, ok := s.roomStreams[req.GetRoomId()]; ok {
-		if msgChan, ok := roomStreams[req.GetUserId()]; ok {
-			close(msgChan)
-			delete(roomStreams, req.GetUserId())
-		}
-		if len(roomStreams) == 0 {
-			delete(s.roomStreams, req.GetRoomId())
-		}
-	}
-	s.roomStreamsMu.Unlock()
+	// Disconnect the user's stream, if any, rather than waiting for them
+	// to notice their membership is gone
+	s.hub.Kick(req.GetRoomId(), req.GetUserId())
 
 	return &proto.LeaveRoomResponse{
 		Success: true,
 	}, nil
 }
 
-// broadcastMessage sends a message to all connected clients in a room
-func (s *ChatCloudServer) broadcastMessage(msg *proto.Message) {
-	s.roomStreamsMu.RLock()
-	defer s.roomStreamsMu.RUnlock()
-
-	if roomStreams, ok := s.roomStreams[msg.RoomId]; ok {
-		for _, msgChan := range roomStreams {
-			select {
-			case msgChan <- msg:
-			default:
-				log.Printf("Channel full, dropping message")
-			}
-		}
-	}
-}
-
-
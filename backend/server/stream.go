@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/chatcloud/backend/proto"
+)
+
+// streamMessagePayload is the JSON body stored in each Redis Stream entry's
+// "json" field. Keeping a single encoded field (rather than one Redis
+// Stream field per Go field) means new fields can be added here without
+// breaking readers of older entries.
+type streamMessagePayload struct {
+	UserID    string            `json:"user_id"`
+	Content   string            `json:"content"`
+	ReplyToID string            `json:"reply_to_id,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// streamKey returns the Redis Stream key holding a room's messages.
+func streamKey(roomID string) string {
+	return roomKey(roomID, "stream")
+}
+
+// streamIDTimestampMillis extracts the millisecond component of a Redis
+// Stream entry ID ("<millis>-<seq>"), which doubles as the message's
+// send time.
+func streamIDTimestampMillis(id string) int64 {
+	msPart := id
+	if idx := strings.IndexByte(id, '-'); idx >= 0 {
+		msPart = id[:idx]
+	}
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return ms
+}
+
+// decodeStreamMessage turns a raw Redis Stream entry into a proto.Message.
+func decodeStreamMessage(roomID string, entry redis.XMessage) (*proto.Message, error) {
+	raw, ok := entry.Values["json"].(string)
+	if !ok {
+		return nil, fmt.Errorf("stream entry %s missing json field", entry.ID)
+	}
+
+	var payload streamMessagePayload
+	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		return nil, fmt.Errorf("decoding stream entry %s: %w", entry.ID, err)
+	}
+
+	return &proto.Message{
+		Id:        entry.ID,
+		UserId:    payload.UserID,
+		RoomId:    roomID,
+		Content:   payload.Content,
+		ReplyToId: payload.ReplyToID,
+		Timestamp: streamIDTimestampMillis(entry.ID),
+	}, nil
+}
+
+// MessageIterator pages through a room's message stream, hiding the
+// XRANGE/XREVRANGE cursor semantics so GetHistory and any future
+// export/backfill tooling can share the same traversal logic.
+type MessageIterator struct {
+	rdb     redis.UniversalClient
+	roomID  string
+	reverse bool
+}
+
+// newMessageIterator creates a MessageIterator over roomID's stream.
+// reverse selects newest-to-oldest iteration (XREVRANGE); otherwise
+// iteration runs oldest-to-newest (XRANGE).
+func newMessageIterator(rdb redis.UniversalClient, roomID string, reverse bool) *MessageIterator {
+	return &MessageIterator{rdb: rdb, roomID: roomID, reverse: reverse}
+}
+
+// Page returns up to count messages after cursor (exclusive) in the
+// iterator's direction, along with the stream ID to pass as the next
+// cursor. An empty cursor starts from the iterator's natural beginning
+// (the newest entry if reverse, the oldest otherwise).
+func (it *MessageIterator) Page(ctx context.Context, cursor string, count int64) ([]*proto.Message, string, error) {
+	start, end := "-", "+"
+	if it.reverse {
+		start, end = "+", "-"
+	}
+	// In both directions the cursor tightens start, the bound XRANGE/XREVRANGE
+	// walk away from: for XREVRANGE, start is the high end (<high> <low>), so
+	// excluding cursor there is what actually excludes the entries already
+	// returned by the previous page.
+	if cursor != "" {
+		start = "(" + cursor
+	}
+
+	key := streamKey(it.roomID)
+	var (
+		entries []redis.XMessage
+		err     error
+	)
+	if it.reverse {
+		entries, err = it.rdb.XRevRangeN(ctx, key, start, end, count).Result()
+	} else {
+		entries, err = it.rdb.XRangeN(ctx, key, start, end, count).Result()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	messages := make([]*proto.Message, 0, len(entries))
+	for _, entry := range entries {
+		msg, err := decodeStreamMessage(it.roomID, entry)
+		if err != nil {
+			log.Printf("Error decoding stream message: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	var next string
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].Id
+	}
+	return messages, next, nil
+}
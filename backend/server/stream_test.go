@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestStreamRDB returns a redis client backed by an in-memory miniredis
+// instance, seeded with count messages in roomID's stream.
+func newTestStreamRDB(t *testing.T, roomID string, count int) redis.UniversalClient {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	ctx := context.Background()
+	for i := 0; i < count; i++ {
+		encoded, err := json.Marshal(streamMessagePayload{UserID: "user", Content: "msg"})
+		if err != nil {
+			t.Fatalf("encoding seed message: %v", err)
+		}
+		if err := rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamKey(roomID),
+			Values: map[string]interface{}{"json": encoded},
+		}).Err(); err != nil {
+			t.Fatalf("seeding stream entry %d: %v", i, err)
+		}
+	}
+
+	return rdb
+}
+
+func TestMessageIteratorPageBackwardDoesNotRepeat(t *testing.T) {
+	const roomID = "room-1"
+	rdb := newTestStreamRDB(t, roomID, 10)
+	ctx := context.Background()
+
+	it := newMessageIterator(rdb, roomID, true)
+
+	firstPage, cursor, err := it.Page(ctx, "", 3)
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	if len(firstPage) != 3 {
+		t.Fatalf("first page: got %d messages, want 3", len(firstPage))
+	}
+	if cursor != firstPage[len(firstPage)-1].Id {
+		t.Fatalf("first page cursor = %q, want %q", cursor, firstPage[len(firstPage)-1].Id)
+	}
+
+	secondPage, _, err := it.Page(ctx, cursor, 3)
+	if err != nil {
+		t.Fatalf("second page: %v", err)
+	}
+	if len(secondPage) != 3 {
+		t.Fatalf("second page: got %d messages, want 3", len(secondPage))
+	}
+
+	seen := make(map[string]bool, 6)
+	for _, msg := range firstPage {
+		seen[msg.Id] = true
+	}
+	for _, msg := range secondPage {
+		if seen[msg.Id] {
+			t.Fatalf("second page re-returned message %s from the first page", msg.Id)
+		}
+		seen[msg.Id] = true
+	}
+}
+
+func TestMessageIteratorPageForwardDoesNotRepeat(t *testing.T) {
+	const roomID = "room-2"
+	rdb := newTestStreamRDB(t, roomID, 10)
+	ctx := context.Background()
+
+	it := newMessageIterator(rdb, roomID, false)
+
+	firstPage, cursor, err := it.Page(ctx, "", 3)
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	if len(firstPage) != 3 {
+		t.Fatalf("first page: got %d messages, want 3", len(firstPage))
+	}
+
+	secondPage, _, err := it.Page(ctx, cursor, 3)
+	if err != nil {
+		t.Fatalf("second page: %v", err)
+	}
+
+	seen := make(map[string]bool, 6)
+	for _, msg := range firstPage {
+		seen[msg.Id] = true
+	}
+	for _, msg := range secondPage {
+		if seen[msg.Id] {
+			t.Fatalf("second page re-returned message %s from the first page", msg.Id)
+		}
+		seen[msg.Id] = true
+	}
+}